@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombudslib/rpcexten"
+	"github.com/soapboxsys/ombwallet/chain"
+	"github.com/soapboxsys/ombwallet/txstore"
+	"github.com/soapboxsys/ombwallet/waddrmgr"
+)
+
+// TODO NOTICE
+// Handles a bumpbulletinfee json request. Rebuilds the bulletin transaction
+// identified by cmd.TxId with the same author input(s) and the same
+// bulletin payload outputs, verbatim, but with every input's sequence number
+// set to rbfSequence (BIP125 rule 1) and a higher feerate. Additional inputs are
+// pulled from findEligibleOutputs if the original ones can't cover the new
+// fee. The replacement must itself satisfy BIP125 rule 4 (it pays for its
+// own bandwidth above the fee the original tx paid) before it is broadcast.
+func BumpBulletinFee(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interface{}, error) {
+	cmd := icmd.(rpcexten.BumpBulletinFeeCmd)
+
+	if cmd.FeeIncrement <= w.FeeIncrement {
+		return nil, errors.New("bumpbulletinfee requires a fee increment higher than the wallet's current one")
+	}
+
+	oldHash, err := wire.NewShaHashFromStr(cmd.TxId)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("Starting bulletin fee bump")
+	heldUnlock, err := w.HoldUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer heldUnlock.Release()
+
+	oldTxr, err := w.TxStore.FindTx(oldHash)
+	if err != nil {
+		return nil, err
+	}
+	oldTx := oldTxr.MsgTx()
+	oldFee, err := oldTxr.Fee()
+	if err != nil {
+		return nil, err
+	}
+
+	// Recover the credits oldTx spent. They're still tracked by the store
+	// even though oldTx marks them spent, since oldTx is unconfirmed and is
+	// about to be replaced.
+	inputs := make([]txstore.Credit, len(oldTx.TxIn))
+	for idx, txin := range oldTx.TxIn {
+		credit, err := w.TxStore.Credit(&txin.PreviousOutPoint)
+		if err != nil {
+			return nil, fmt.Errorf("cannot bump fee: original input %v is no longer tracked: %v",
+				txin.PreviousOutPoint, err)
+		}
+		inputs[idx] = credit
+	}
+	var totalAdded btcutil.Amount
+	for _, c := range inputs {
+		totalAdded += c.Amount()
+	}
+
+	burnOuts, changeAddr, hadChange := splitBulletinOutputs(oldTx, w.Manager)
+	var totalBurn btcutil.Amount
+	for _, txout := range burnOuts {
+		totalBurn += btcutil.Amount(txout.Value)
+	}
+	if !hadChange {
+		// Nothing claims the original input's change; return any surplus
+		// to the address that authored the bulletin.
+		_, addrs, _, err := inputs[0].Addresses(activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+		changeAddr = addrs[0]
+	}
+
+	bs, err := chainSrv.BlockStamp()
+	if err != nil {
+		return nil, err
+	}
+	eligible, err := w.findEligibleOutputs(1, bs)
+	if err != nil {
+		return nil, err
+	}
+	eligible = remainingCredits(eligible, inputs)
+
+	msgtx := wire.NewMsgTx()
+	for _, in := range oldTx.TxIn {
+		newIn := wire.NewTxIn(&in.PreviousOutPoint, nil)
+		newIn.Sequence = rbfSequence
+		msgtx.AddTxIn(newIn)
+	}
+	for _, txout := range burnOuts {
+		msgtx.AddTxOut(txout)
+	}
+
+	szEst, err := estimateTxSize(inputs, len(msgtx.TxOut)+1, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	feeEst := minimumFee(cmd.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+
+	for totalAdded < totalBurn+feeEst {
+		if len(eligible) == 0 {
+			return nil, InsufficientFundsError{totalAdded, totalBurn, feeEst}
+		}
+		var input txstore.Credit
+		input, eligible = eligible[0], eligible[1:]
+		inputs = append(inputs, input)
+		in := wire.NewTxIn(input.OutPoint(), nil)
+		in.Sequence = rbfSequence
+		msgtx.AddTxIn(in)
+		if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut)+1, w.Manager); err != nil {
+			return nil, err
+		}
+		totalAdded += input.Amount()
+		feeEst = minimumFee(cmd.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+	}
+
+	changeIdx := -1
+
+	log.Trace("Formulating the replacement transaction and computing fees")
+	for {
+		change := totalAdded - totalBurn - feeEst
+		if change > 0 {
+			pkScript, err := txscript.PayToAddrScript(changeAddr)
+			if err != nil {
+				return nil, err
+			}
+			msgtx.AddTxOut(wire.NewTxOut(int64(change), pkScript))
+			changeIdx = len(msgtx.TxOut) - 1
+		}
+
+		// Recomputed every pass: hashPrevouts/hashSequence/hashOutputs all
+		// depend on msgtx's current input/output set.
+		hashCache := txscript.NewTxSigHashes(msgtx)
+
+		if err = signMsgTx(msgtx, inputs, w.Manager, hashCache); err != nil {
+			return nil, err
+		}
+
+		if feeForSize(cmd.FeeIncrement, msgtx.SerializeSize()) <= feeEst {
+			break
+		}
+
+		if change > 0 {
+			tmp := msgtx.TxOut[:changeIdx]
+			tmp = append(tmp, msgtx.TxOut[changeIdx+1:]...)
+			msgtx.TxOut = tmp
+		}
+
+		feeEst += cmd.FeeIncrement
+		for totalAdded < totalBurn+feeEst {
+			if len(eligible) == 0 {
+				return nil, InsufficientFundsError{totalAdded, totalBurn, feeEst}
+			}
+			var input txstore.Credit
+			input, eligible = eligible[0], eligible[1:]
+			inputs = append(inputs, input)
+			in := wire.NewTxIn(input.OutPoint(), nil)
+			in.Sequence = rbfSequence
+			msgtx.AddTxIn(in)
+			if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+				return nil, err
+			}
+			totalAdded += input.Amount()
+			feeEst = minimumFee(cmd.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+		}
+	}
+
+	if err := validateMsgTx(msgtx, inputs); err != nil {
+		return nil, err
+	}
+
+	// BIP125 rule 4: the replacement must pay a fee at least equal to the
+	// original's fee plus the minimum relay fee for the replacement's own
+	// size.
+	var totalOut btcutil.Amount
+	for _, txout := range msgtx.TxOut {
+		totalOut += btcutil.Amount(txout.Value)
+	}
+	newFee := totalAdded - totalOut
+	minRelayFee := feeForSize(w.FeeIncrement, msgtx.SerializeSize())
+	if newFee < oldFee+minRelayFee {
+		return nil, fmt.Errorf("replacement fee %v does not satisfy BIP125 rule 4 (need at least %v)",
+			newFee, oldFee+minRelayFee)
+	}
+
+	log.Trace("Marking the original bulletin as replaced")
+	txSha, err := chainSrv.SendRawTransaction(msgtx, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = insertIntoStore(w.TxStore, msgtx); err != nil {
+		return nil, err
+	}
+	if err = w.TxStore.MarkReplaced(oldHash, txSha); err != nil {
+		return nil, err
+	}
+	log.Infof("Successfully bumped bulletin %v to %v", oldHash, txSha)
+
+	return txSha.String(), nil
+}
+
+// splitBulletinOutputs separates a bulletin transaction's burn outputs from
+// a trailing change output, if it has one. A trailing output is treated as
+// change only if it pays an address this wallet manages -- otherwise every
+// output is treated as part of the bulletin payload.
+func splitBulletinOutputs(tx *wire.MsgTx, mgr *waddrmgr.Manager) ([]*wire.TxOut, btcutil.Address, bool) {
+	if len(tx.TxOut) == 0 {
+		return tx.TxOut, nil, false
+	}
+	last := tx.TxOut[len(tx.TxOut)-1]
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(last.PkScript, activeNet.Params)
+	if err != nil || len(addrs) != 1 {
+		return tx.TxOut, nil, false
+	}
+	if _, err := mgr.Address(addrs[0]); err != nil {
+		return tx.TxOut, nil, false
+	}
+	return tx.TxOut[:len(tx.TxOut)-1], addrs[0], true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombwallet/txstore"
+)
+
+// maxSelectionTries bounds the branch-and-bound search in selectCoins so a
+// pathological eligible set can't make SendBulletin hang.
+const maxSelectionTries = 100000
+
+// selectCoins runs a Murch-style branch-and-bound search over eligible,
+// sorted descending by effective value (amount minus the marginal fee of
+// spending it), looking for a subset whose total lands in
+// [target, target+costOfChange]. A match in that range means the
+// transaction can be built without a change output at all. Besides the
+// maxSelectionTries backstop, the search prunes a branch as soon as its
+// total reaches target -- further coins can only grow it, so the branch is
+// recorded as a candidate (if its waste fits costOfChange) and abandoned
+// rather than explored deeper -- and as soon as it's unreachable, meaning
+// even every coin left in the pool wouldn't bring the total up to target.
+//
+// It returns the chosen subset and true on success. On failure -- no
+// combination found within maxSelectionTries -- the caller should fall back
+// to the existing greedy selection.
+func selectCoins(eligible []txstore.Credit, target, costOfChange btcutil.Amount, feeIncrement btcutil.Amount) ([]txstore.Credit, bool) {
+	effValue := func(c txstore.Credit) btcutil.Amount {
+		return c.Amount() - feeForSize(feeIncrement, txInEstimate)
+	}
+
+	pool := make([]txstore.Credit, len(eligible))
+	copy(pool, eligible)
+	sort.Sort(sort.Reverse(byEffectiveValue{pool, effValue}))
+
+	// remainingSum[idx] holds the sum of effValue(pool[idx:]), so a branch
+	// can be abandoned the moment even taking every coin left in the pool
+	// couldn't reach target -- the "unreachable" bound -- rather than
+	// descending through all 2^n combinations of a branch that can never
+	// succeed.
+	remainingSum := make([]btcutil.Amount, len(pool)+1)
+	for i := len(pool) - 1; i >= 0; i-- {
+		remainingSum[i] = remainingSum[i+1] + effValue(pool[i])
+	}
+
+	var (
+		best     []txstore.Credit
+		bestWaste btcutil.Amount = -1
+		tries    int
+	)
+
+	var search func(idx int, selected []txstore.Credit, total btcutil.Amount)
+	search = func(idx int, selected []txstore.Credit, total btcutil.Amount) {
+		tries++
+		if tries > maxSelectionTries || bestWaste == 0 {
+			return
+		}
+
+		if total >= target {
+			waste := total - target
+			if waste <= costOfChange && (bestWaste == -1 || waste < bestWaste) {
+				best = append([]txstore.Credit(nil), selected...)
+				bestWaste = waste
+			}
+			// Adding further coins can only increase an already-passing
+			// total, so don't descend further down this branch (the
+			// "overshoot" bound).
+			return
+		}
+
+		if idx >= len(pool) || total+remainingSum[idx] < target {
+			// Even every coin left in the pool can't reach target, so no
+			// combination below this branch can succeed (the
+			// "unreachable" bound).
+			return
+		}
+
+		// Branch 1: include pool[idx].
+		search(idx+1, append(selected, pool[idx]), total+effValue(pool[idx]))
+		if tries > maxSelectionTries || bestWaste == 0 {
+			return
+		}
+		// Branch 2: exclude pool[idx].
+		search(idx+1, selected, total)
+	}
+
+	search(0, nil, 0)
+	return best, best != nil
+}
+
+// remainingCredits returns the credits in all that are not present in used,
+// compared by outpoint. used need not be a subset of all -- the bump-fee
+// path calls this with used set to the old tx's (now-spent) inputs, which
+// generally aren't present in all at all -- so the result can be as large
+// as all itself.
+func remainingCredits(all, used []txstore.Credit) []txstore.Credit {
+	usedSet := make(map[string]bool, len(used))
+	for _, c := range used {
+		usedSet[c.OutPoint().String()] = true
+	}
+
+	remaining := make([]txstore.Credit, 0, len(all))
+	for _, c := range all {
+		if !usedSet[c.OutPoint().String()] {
+			remaining = append(remaining, c)
+		}
+	}
+	return remaining
+}
+
+// byEffectiveValue sorts credits by an externally supplied effective-value
+// function, ascending.
+type byEffectiveValue struct {
+	credits []txstore.Credit
+	value   func(txstore.Credit) btcutil.Amount
+}
+
+func (s byEffectiveValue) Len() int { return len(s.credits) }
+func (s byEffectiveValue) Less(i, j int) bool {
+	return s.value(s.credits[i]) < s.value(s.credits[j])
+}
+func (s byEffectiveValue) Swap(i, j int) {
+	s.credits[i], s.credits[j] = s.credits[j], s.credits[i]
+}
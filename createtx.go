@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombwallet/txstore"
+	"github.com/soapboxsys/ombwallet/waddrmgr"
+)
+
+const (
+	// txInEstimate is the worst-case serialized size, in bytes, of a
+	// legacy P2PKH transaction input: outpoint (36) + sequence (4) +
+	// a varint-prefixed DER signature push + compressed pubkey push.
+	txInEstimate = 148
+
+	// txInEstimateSegwit is the base (non-witness) size, in bytes, of a
+	// native P2WPKH input. The SignatureScript is empty, so this is just
+	// the outpoint, sequence, and an empty script length byte.
+	txInEstimateSegwit = 41
+
+	// txInEstimateNestedSegwit is the base size, in bytes, of a
+	// nested P2SH-P2WPKH input. Unlike native segwit, SignatureScript
+	// carries a single push of the 22-byte witness program.
+	txInEstimateNestedSegwit = 64
+
+	// txWitnessEstimate is the size, in bytes, of the witness stack
+	// (signature push + compressed pubkey push) attached to a P2WPKH
+	// input, native or nested.
+	txWitnessEstimate = 108
+
+	// txOutEstimate is the worst-case serialized size, in bytes, of a
+	// P2PKH transaction output.
+	txOutEstimate = 34
+
+	// rbfSequence is the nSequence value bulletin-authoring transactions
+	// set on every input by default, so a later bumpbulletinfee call can
+	// replace them per BIP125 rule 1. Any value strictly below
+	// 0xfffffffe signals replaceability; wire.MaxTxInSequenceNum (the
+	// wire package's default for a freshly built TxIn) does not.
+	rbfSequence = 0xfffffffd
+)
+
+// creditInputKind classifies how a credit's previous output must be spent,
+// since that determines both its signing procedure and its size on the
+// wire.
+type creditInputKind int
+
+const (
+	inputP2PKH creditInputKind = iota
+	inputP2WKH
+	inputP2SHP2WKH
+	inputP2SHMultisig
+)
+
+// classifyCredit inspects a credit's previous output script and reports how
+// it must be spent. mgr is consulted when the script is a P2SH output, to
+// look up the redeem script and check whether it is a v0 P2WKH program or a
+// bare multisig script.
+func classifyCredit(credit txstore.Credit, mgr *waddrmgr.Manager) (creditInputKind, error) {
+	kind, err := classifyScript(credit.PkScript(), mgr)
+	if err != nil {
+		return 0, fmt.Errorf("credit %v: %v", credit.OutPoint(), err)
+	}
+	return kind, nil
+}
+
+// classifyScript inspects a previous output script directly and reports how
+// it must be spent. mgr is consulted when the script is a P2SH output, to
+// look up the redeem script and check whether it is a v0 P2WKH program or a
+// bare multisig script. Unlike classifyCredit, this doesn't require the
+// output to be tracked in the txstore -- it only needs the pkScript -- so
+// it also covers change outputs a caller has just created itself, such as
+// the intermediate hops of a sendlongbulletin chain.
+func classifyScript(pkScript []byte, mgr *waddrmgr.Manager) (creditInputKind, error) {
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, activeNet.Params)
+	if err != nil {
+		return 0, err
+	}
+
+	switch class {
+	case txscript.PubKeyHashTy:
+		return inputP2PKH, nil
+
+	case txscript.WitnessV0PubKeyHashTy:
+		return inputP2WKH, nil
+
+	case txscript.ScriptHashTy:
+		ainfo, err := mgr.Address(addrs[0])
+		if err != nil {
+			return 0, err
+		}
+		sa, ok := ainfo.(waddrmgr.ManagedScriptAddress)
+		if !ok {
+			return 0, fmt.Errorf("P2SH output is not a managed script address")
+		}
+		redeem, err := sa.Script()
+		if err != nil {
+			return 0, err
+		}
+		if txscript.IsWitnessPubKeyHashScript(redeem) {
+			return inputP2SHP2WKH, nil
+		}
+		redeemClass, _, _, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+		if err == nil && redeemClass == txscript.MultiSigTy {
+			return inputP2SHMultisig, nil
+		}
+		return 0, fmt.Errorf("redeem script is neither a v0 P2WKH program nor a bare multisig script")
+
+	default:
+		return 0, fmt.Errorf("unsupported script class %v", class)
+	}
+}
+
+// newRBFTxIn builds a TxIn spending op with its sequence number set to
+// rbfSequence, so every bulletin-authoring transaction signals BIP125
+// replaceability from the start and can later be fee-bumped via
+// bumpbulletinfee.
+func newRBFTxIn(op *wire.OutPoint) *wire.TxIn {
+	txIn := wire.NewTxIn(op, nil)
+	txIn.Sequence = rbfSequence
+	return txIn
+}
+
+// feeForSize returns the minimum fee, given a fee increment and the size in
+// bytes of a transaction, using the formula fee = increment * size / 1000,
+// truncated to a whole satoshi. A result that truncates to zero is raised to
+// increment.
+func feeForSize(incr btcutil.Amount, sz int) btcutil.Amount {
+	fee := incr * btcutil.Amount(sz) / 1000
+	if fee == 0 && incr > 0 {
+		fee = incr
+	}
+	return fee
+}
+
+// inputSizeForKind returns the base (non-witness) and witness size, in
+// bytes, of a single input of the given kind. It does not cover
+// inputP2SHMultisig, whose size depends on the credit's own redeem script;
+// callers spending a multisig credit must use estimateMultisigInputSize
+// instead.
+func inputSizeForKind(kind creditInputKind) (base, witness int) {
+	switch kind {
+	case inputP2WKH:
+		return txInEstimateSegwit, txWitnessEstimate
+	case inputP2SHP2WKH:
+		return txInEstimateNestedSegwit, txWitnessEstimate
+	default:
+		return txInEstimate, 0
+	}
+}
+
+// estimateTxSize returns the estimated virtual size, in vbytes, of a
+// transaction spending the given inputs and producing numOutputs P2PKH-sized
+// outputs. Segwit inputs contribute their witness data at a quarter weight,
+// per BIP141's (base size * 3 + total size) / 4 formula.
+func estimateTxSize(inputs []txstore.Credit, numOutputs int, mgr *waddrmgr.Manager) (int, error) {
+	baseSz := 10 // version + locktime + input/output count varints (approx)
+	witnessSz := 0
+
+	for _, credit := range inputs {
+		kind, err := classifyCredit(credit, mgr)
+		if err != nil {
+			return 0, err
+		}
+		if kind == inputP2SHMultisig {
+			sz, err := estimateMultisigInputSize(credit, mgr)
+			if err != nil {
+				return 0, err
+			}
+			baseSz += sz
+			continue
+		}
+		base, witness := inputSizeForKind(kind)
+		baseSz += base
+		witnessSz += witness
+	}
+	baseSz += numOutputs * txOutEstimate
+
+	totalSz := baseSz + witnessSz
+	vsize := (baseSz*3 + totalSz) / 4
+	return vsize, nil
+}
+
+// minimumFee returns the minimum fee required for a transaction of sz bytes
+// given the wallet's configured fee increment.
+func minimumFee(incr btcutil.Amount, sz int, outputs []*wire.TxOut, inputs []txstore.Credit, height int32) btcutil.Amount {
+	return feeForSize(incr, sz)
+}
+
+// signMsgTx signs each of tx's inputs in place against the corresponding
+// credit, using mgr to locate the signing key (or redeem script, for P2SH
+// inputs). hashCache is the BIP143 sighash midstate for tx as it currently
+// stands; since it covers tx's full input and output set, callers rebuild it
+// on every pass of the fee-bump loop, after the change output is settled.
+func signMsgTx(tx *wire.MsgTx, inputs []txstore.Credit, mgr *waddrmgr.Manager, hashCache *txscript.TxSigHashes) error {
+	for i, credit := range inputs {
+		kind, err := classifyCredit(credit, mgr)
+		if err != nil {
+			return err
+		}
+
+		if kind == inputP2SHMultisig {
+			// A bare multisig credit can only be fully signed here if this
+			// wallet alone holds enough of the cosigners' keys to meet the
+			// threshold; otherwise use the two-phase signbulletin RPC to
+			// collect the remaining partial signatures out-of-band.
+			if err := signMultisigCreditInPlace(tx, i, credit, mgr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := signScriptInput(tx, i, kind, credit.PkScript(), credit.Amount(), mgr, hashCache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signScriptInput signs tx's i'th input in place, given the previous
+// output's already-classified kind, pkScript, and amount. It covers every
+// creditInputKind except inputP2SHMultisig, which needs a txstore.Credit
+// and is handled separately by signMultisigCreditInPlace. Unlike signMsgTx,
+// this doesn't require the previous output to be tracked by the txstore, so
+// it also signs inputs spending a change output this process just created
+// itself, such as the intermediate hops of a sendlongbulletin chain.
+func signScriptInput(tx *wire.MsgTx, i int, kind creditInputKind, prevScript []byte, amount btcutil.Amount, mgr *waddrmgr.Manager, hashCache *txscript.TxSigHashes) error {
+	switch kind {
+	case inputP2PKH:
+		sigScript, err := txscript.SignTxOutput(activeNet.Params, tx, i,
+			prevScript, txscript.SigHashAll, mgr, nil, nil)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[i].SignatureScript = sigScript
+		return nil
+
+	case inputP2WKH, inputP2SHP2WKH:
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(prevScript, activeNet.Params)
+		if err != nil {
+			return err
+		}
+		ainfo, err := mgr.Address(addrs[0])
+		if err != nil {
+			return err
+		}
+		pka, ok := ainfo.(waddrmgr.ManagedPubKeyAddress)
+		if !ok {
+			return fmt.Errorf("input %d is not a managed pubkey address", i)
+		}
+		privKey, err := pka.PrivKey()
+		if err != nil {
+			return err
+		}
+
+		pubKey := privKey.PubKey().SerializeCompressed()
+		witnessProgram := txscript.WitnessV0PubKeyHashScript(pubKey)
+
+		// BIP143 mandates that the scriptCode for a v0 P2WKH input is
+		// the implicit P2PKH script OP_DUP OP_HASH160 <hash>
+		// OP_EQUALVERIFY OP_CHECKSIG, not the witness program itself.
+		scriptCode, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_DUP).
+			AddOp(txscript.OP_HASH160).
+			AddData(btcutil.Hash160(pubKey)).
+			AddOp(txscript.OP_EQUALVERIFY).
+			AddOp(txscript.OP_CHECKSIG).
+			Script()
+		if err != nil {
+			return err
+		}
+		sig, err := txscript.RawTxInWitnessSignature(tx, hashCache, i,
+			int64(amount), scriptCode, txscript.SigHashAll, privKey)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[i].Witness = wire.TxWitness{sig, pubKey}
+
+		if kind == inputP2SHP2WKH {
+			builder := txscript.NewScriptBuilder()
+			builder.AddData(witnessProgram)
+			sigScript, err := builder.Script()
+			if err != nil {
+				return err
+			}
+			tx.TxIn[i].SignatureScript = sigScript
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("input %d has a script kind that requires a tracked credit", i)
+	}
+}
+
+// validateMsgTx executes each input's scriptSig/witness against its
+// previous output script, returning an error for the first one that fails
+// to validate.
+func validateMsgTx(tx *wire.MsgTx, inputs []txstore.Credit) error {
+	for i, credit := range inputs {
+		vm, err := txscript.NewEngine(credit.PkScript(), tx, i,
+			txscript.StandardVerifyFlags, nil, nil, int64(credit.Amount()))
+		if err != nil {
+			return err
+		}
+		if err := vm.Execute(); err != nil {
+			return fmt.Errorf("cannot validate transaction input %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// ByAmount sorts a slice of credits by amount, ascending.
+type ByAmount []txstore.Credit
+
+func (s ByAmount) Len() int           { return len(s) }
+func (s ByAmount) Less(i, j int) bool { return s[i].Amount() < s[j].Amount() }
+func (s ByAmount) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// InsufficientFundsError records that the eligible outputs available could
+// not cover the requested burn amount plus fee.
+type InsufficientFundsError struct {
+	in, out, fee btcutil.Amount
+}
+
+func (e InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds: have %v, need %v plus %v fee", e.in, e.out, e.fee)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// TestClassifyScript checks the P2PKH and native P2WKH cases, neither of
+// which needs a *waddrmgr.Manager (only the P2SH case does, to look up the
+// redeem script), so they can run without a real wallet.
+func TestClassifyScript(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pubKey := priv.PubKey().SerializeCompressed()
+	pubKeyHash := btcutil.Hash160(pubKey)
+
+	p2pkhAddr, err := btcutil.NewAddressPubKeyHash(pubKeyHash, activeNet.Params)
+	if err != nil {
+		t.Fatalf("building P2PKH address: %v", err)
+	}
+	p2pkhScript, err := txscript.PayToAddrScript(p2pkhAddr)
+	if err != nil {
+		t.Fatalf("building P2PKH script: %v", err)
+	}
+
+	p2wkhScript := txscript.WitnessV0PubKeyHashScript(pubKey)
+
+	tests := []struct {
+		name   string
+		script []byte
+		want   creditInputKind
+	}{
+		{"P2PKH", p2pkhScript, inputP2PKH},
+		{"native P2WKH", p2wkhScript, inputP2WKH},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := classifyScript(tc.script, nil)
+			if err != nil {
+				t.Fatalf("classifyScript: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("classifyScript(%s) = %v, want %v", tc.name, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestP2WKHScriptCodeValidates pins down the BIP143 scriptCode construction
+// used when signing a native P2WKH input: the scriptCode committed to by
+// the signature must be the implicit P2PKH script
+// (OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG), not the witness
+// program (OP_0 <hash>) itself. Signing against the wrong scriptCode
+// produces a signature that fails to validate.
+func TestP2WKHScriptCodeValidates(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pubKey := priv.PubKey().SerializeCompressed()
+
+	witnessProgram := txscript.WitnessV0PubKeyHashScript(pubKey)
+
+	var prevHash wire.ShaHash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatalf("generating prev hash: %v", err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil))
+	tx.AddTxOut(wire.NewTxOut(1e8, witnessProgram))
+
+	scriptCode, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_DUP).
+		AddOp(txscript.OP_HASH160).
+		AddData(btcutil.Hash160(pubKey)).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		t.Fatalf("building scriptCode: %v", err)
+	}
+
+	hashCache := txscript.NewTxSigHashes(tx)
+	sig, err := txscript.RawTxInWitnessSignature(tx, hashCache, 0, 1e8, scriptCode, txscript.SigHashAll, priv)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	tx.TxIn[0].Witness = wire.TxWitness{sig, pubKey}
+
+	vm, err := txscript.NewEngine(witnessProgram, tx, 0, txscript.StandardVerifyFlags, nil, hashCache, 1e8)
+	if err != nil {
+		t.Fatalf("building script engine: %v", err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Fatalf("witness failed to validate with the implicit P2PKH scriptCode: %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/soapboxsys/ombudslib/rpcexten"
 	"github.com/soapboxsys/ombwallet/chain"
 	"github.com/soapboxsys/ombwallet/txstore"
+	"github.com/soapboxsys/ombwallet/waddrmgr"
 )
 
 // TODO NOTICE
@@ -75,7 +76,7 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 	log.Trace("Searching for a UTXO with target address.")
 	// Find the index of the credit with the target address and use that as the
 	// first txin in the bulletin.
-	i, err := findAddrCredit(eligible, addr)
+	i, err := findAddrCredit(eligible, addr, w.Manager)
 	if err != nil {
 		log.Trace("No eligible credits found for addr: %s", addr)
 		return nil, err
@@ -83,30 +84,56 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 
 	authc := eligible[i]
 	// Add authoring txin
-	msgtx.AddTxIn(wire.NewTxIn(authc.OutPoint(), nil))
+	msgtx.AddTxIn(newRBFTxIn(authc.OutPoint()))
 
-	// Remove the author credit
+	// Remove the author credit; it's already committed above, so coin
+	// selection only needs to search the remainder.
 	eligible = append(eligible[:i], eligible[i+1:]...)
-	sort.Sort(sort.Reverse(ByAmount(eligible)))
 	totalAdded := authc.Amount()
 	inputs := []txstore.Credit{authc}
 	var input txstore.Credit
 
-	for totalAdded < totalBurn {
-		if len(eligible) == 0 {
-			return nil, InsufficientFundsError{totalAdded, totalBurn, 0}
-		}
-		input, eligible = eligible[0], eligible[1:]
-		inputs = append(inputs, input)
-		msgtx.AddTxIn(wire.NewTxIn(input.OutPoint(), nil))
-		totalAdded += input.Amount()
-	}
-
 	log.Trace("Estimating fee")
-	// Initial fee estimate
-	szEst := estimateTxSize(len(inputs), len(msgtx.TxOut))
+	// Rough initial fee estimate, author credit only, used to size the
+	// coin selection target below.
+	szEst, err := estimateTxSize(inputs, len(msgtx.TxOut), w.Manager)
+	if err != nil {
+		return nil, err
+	}
 	feeEst := minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
 
+	if totalAdded < totalBurn+feeEst {
+		target := totalBurn + feeEst - totalAdded
+		costOfChange := feeForSize(w.FeeIncrement, txOutEstimate) + rpcexten.DustAmnt()
+
+		if selected, ok := selectCoins(eligible, target, costOfChange, w.FeeIncrement); ok {
+			log.Trace("Branch-and-bound coin selection found a matching subset")
+			for _, sel := range selected {
+				inputs = append(inputs, sel)
+				msgtx.AddTxIn(newRBFTxIn(sel.OutPoint()))
+				totalAdded += sel.Amount()
+			}
+			eligible = remainingCredits(eligible, selected)
+		} else {
+			log.Trace("Branch-and-bound selection failed, falling back to greedy")
+			sort.Sort(sort.Reverse(ByAmount(eligible)))
+			for totalAdded < totalBurn {
+				if len(eligible) == 0 {
+					return nil, InsufficientFundsError{totalAdded, totalBurn, 0}
+				}
+				input, eligible = eligible[0], eligible[1:]
+				inputs = append(inputs, input)
+				msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+				totalAdded += input.Amount()
+			}
+		}
+
+		if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+			return nil, err
+		}
+		feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+	}
+
 	// Ensure that we cover the fee and the total burn and if not add another
 	// input.
 	for totalAdded < totalBurn+feeEst {
@@ -115,8 +142,10 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 		}
 		input, eligible = eligible[0], eligible[1:]
 		inputs = append(inputs, input)
-		msgtx.AddTxIn(wire.NewTxIn(input.OutPoint(), nil))
-		szEst += txInEstimate
+		msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+		if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+			return nil, err
+		}
 		totalAdded += input.Amount()
 		feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
 	}
@@ -142,8 +171,14 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 			}
 		}
 
+		// hashCache holds the BIP143 sighash midstate for this pass. It
+		// must be recomputed whenever msgtx's inputs or outputs change --
+		// hashPrevouts/hashSequence/hashOutputs all depend on the full set
+		// -- so it's built fresh here rather than once before the loop.
+		hashCache := txscript.NewTxSigHashes(msgtx)
+
 		log.Trace("Signing the transaction")
-		if err = signMsgTx(msgtx, inputs, w.Manager); err != nil {
+		if err = signMsgTx(msgtx, inputs, w.Manager, hashCache); err != nil {
 			return nil, err
 		}
 
@@ -168,8 +203,10 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 			}
 			input, eligible = eligible[0], eligible[1:]
 			inputs = append(inputs, input)
-			msgtx.AddTxIn(wire.NewTxIn(input.OutPoint(), nil))
-			szEst += txInEstimate
+			msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+			if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+				return nil, err
+			}
 			totalAdded += input.Amount()
 			feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
 		}
@@ -197,8 +234,12 @@ func SendBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interfac
 // TODO NOTICE
 var ErrNoUnspentForAddr error = errors.New("No unspent outputs for this address")
 
-// TODO NOTICE finds a credit that is a P2PKH to the target address
-func findAddrCredit(credits []txstore.Credit, target btcutil.Address) (int, error) {
+// TODO NOTICE finds a credit spendable by the target address, whether it is
+// a plain P2PKH output, a native P2WPKH output, or a P2SH output whose
+// redeem script is either a v0 P2WPKH program or a bare multisig script. mgr
+// is used to resolve the redeem script of P2SH credits so that any other
+// P2SH outputs are excluded.
+func findAddrCredit(credits []txstore.Credit, target btcutil.Address, mgr *waddrmgr.Manager) (int, error) {
 
 	var idx int = -1
 	for i, credit := range credits {
@@ -207,13 +248,25 @@ func findAddrCredit(credits []txstore.Credit, target btcutil.Address) (int, erro
 			return -1, err
 		}
 		switch class {
-		case txscript.PubKeyHashTy:
+		case txscript.PubKeyHashTy, txscript.WitnessV0PubKeyHashTy:
 			if target.EncodeAddress() == addrs[0].EncodeAddress() {
 				idx = i
 				break
 			}
 
-		// Ignore all non P2PKH txouts
+		case txscript.ScriptHashTy:
+			if target.EncodeAddress() != addrs[0].EncodeAddress() {
+				continue
+			}
+			if _, err := classifyCredit(credit, mgr); err != nil {
+				// Neither a v0 P2WKH-nested nor a bare multisig P2SH
+				// credit; not something we know how to author a bulletin
+				// from.
+				continue
+			}
+			idx = i
+
+		// Ignore all other txout types
 		default:
 			continue
 		}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombudslib/protocol/ombproto"
+	"github.com/soapboxsys/ombudslib/rpcexten"
+	"github.com/soapboxsys/ombwallet/chain"
+	"github.com/soapboxsys/ombwallet/txstore"
+	"github.com/soapboxsys/ombwallet/waddrmgr"
+)
+
+// TODO NOTICE
+// Handles a sendbulletins json request. Packs every bulletin in cmd.Bulletins
+// into a single transaction: one authoring TxIn per distinct author address,
+// the concatenated TxOuts of every bulletin, and at most one change output.
+// This amortizes the fee and dust burn of posting several bulletins across a
+// single transaction rather than paying them per-bulletin.
+func SendBulletins(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interface{}, error) {
+	cmd := icmd.(rpcexten.SendBulletinsCmd)
+
+	if len(cmd.Bulletins) == 0 {
+		return nil, errors.New("sendbulletins requires at least one bulletin")
+	}
+
+	log.Trace("Starting batched send")
+	heldUnlock, err := w.HoldUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer heldUnlock.Release()
+
+	bs, err := chainSrv.BlockStamp()
+	if err != nil {
+		return nil, err
+	}
+
+	var eligible []txstore.Credit
+	eligible, err = w.findEligibleOutputs(1, bs)
+	if err != nil {
+		return nil, err
+	}
+
+	msgtx := wire.NewMsgTx()
+
+	// authorAddrs preserves the order bulletins were requested in, so the
+	// first author encountered becomes the default change recipient below.
+	var authorAddrs []btcutil.Address
+	seenAuthors := make(map[string]bool)
+
+	var totalBurn btcutil.Amount
+	for _, b := range cmd.Bulletins {
+		addr, err := btcutil.DecodeAddress(b.Address, activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Manager.Address(addr); err != nil {
+			return nil, err
+		}
+
+		bltn, err := ombproto.NewBulletinFromStr(b.Address, b.Board, b.Message)
+		if err != nil {
+			return nil, err
+		}
+		txouts, err := bltn.TxOuts(rpcexten.DustAmnt(), activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+		for _, txout := range txouts {
+			msgtx.AddTxOut(txout)
+			totalBurn += btcutil.Amount(txout.Value)
+		}
+
+		if !seenAuthors[addr.EncodeAddress()] {
+			seenAuthors[addr.EncodeAddress()] = true
+			authorAddrs = append(authorAddrs, addr)
+		}
+	}
+
+	changeAddr := authorAddrs[0]
+	if cmd.ChangeAddress != "" {
+		changeAddr, err = btcutil.DecodeAddress(cmd.ChangeAddress, activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Trace("Locating one authoring credit per distinct author address")
+	var inputs []txstore.Credit
+	for _, authorAddr := range authorAddrs {
+		idx, err := findAddrCredit(eligible, authorAddr, w.Manager)
+		if err != nil {
+			log.Trace("No eligible credits found for addr: %s", authorAddr)
+			return nil, err
+		}
+		authc := eligible[idx]
+		msgtx.AddTxIn(newRBFTxIn(authc.OutPoint()))
+		inputs = append(inputs, authc)
+		eligible = append(eligible[:idx], eligible[idx+1:]...)
+	}
+
+	var totalAdded btcutil.Amount
+	for _, in := range inputs {
+		totalAdded += in.Amount()
+	}
+
+	log.Trace("Estimating fee")
+	szEst, err := estimateTxSize(inputs, len(msgtx.TxOut), w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	feeEst := minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+
+	if totalAdded < totalBurn+feeEst {
+		target := totalBurn + feeEst - totalAdded
+		costOfChange := feeForSize(w.FeeIncrement, txOutEstimate) + rpcexten.DustAmnt()
+
+		if selected, ok := selectCoins(eligible, target, costOfChange, w.FeeIncrement); ok {
+			for _, sel := range selected {
+				inputs = append(inputs, sel)
+				msgtx.AddTxIn(newRBFTxIn(sel.OutPoint()))
+				totalAdded += sel.Amount()
+			}
+			eligible = remainingCredits(eligible, selected)
+		} else {
+			sort.Sort(sort.Reverse(ByAmount(eligible)))
+			var input txstore.Credit
+			for totalAdded < totalBurn {
+				if len(eligible) == 0 {
+					return nil, InsufficientFundsError{totalAdded, totalBurn, 0}
+				}
+				input, eligible = eligible[0], eligible[1:]
+				inputs = append(inputs, input)
+				msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+				totalAdded += input.Amount()
+			}
+		}
+
+		if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+			return nil, err
+		}
+		feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+	}
+
+	for totalAdded < totalBurn+feeEst {
+		if len(eligible) == 0 {
+			return nil, InsufficientFundsError{totalAdded, totalBurn, feeEst}
+		}
+		var input txstore.Credit
+		input, eligible = eligible[0], eligible[1:]
+		inputs = append(inputs, input)
+		msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+		if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+			return nil, err
+		}
+		totalAdded += input.Amount()
+		feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+	}
+
+	changeIdx := -1
+
+	log.Trace("Formulating the batched transaction and computing fees")
+	for {
+		change := totalAdded - totalBurn - feeEst
+		if change > 0 {
+			pkScript, err := txscript.PayToAddrScript(changeAddr)
+			if err != nil {
+				return nil, err
+			}
+			msgtx.AddTxOut(wire.NewTxOut(int64(change), pkScript))
+			changeIdx = len(msgtx.TxOut) - 1
+		}
+
+		// Recomputed every pass: hashPrevouts/hashSequence/hashOutputs all
+		// depend on msgtx's current input/output set.
+		hashCache := txscript.NewTxSigHashes(msgtx)
+
+		if err = signMsgTx(msgtx, inputs, w.Manager, hashCache); err != nil {
+			return nil, err
+		}
+
+		if feeForSize(w.FeeIncrement, msgtx.SerializeSize()) <= feeEst {
+			break
+		}
+
+		if change > 0 {
+			tmp := msgtx.TxOut[:changeIdx]
+			tmp = append(tmp, msgtx.TxOut[changeIdx+1:]...)
+			msgtx.TxOut = tmp
+		}
+
+		feeEst += w.FeeIncrement
+		for totalAdded < totalBurn+feeEst {
+			if len(eligible) == 0 {
+				return nil, InsufficientFundsError{totalAdded, totalBurn, feeEst}
+			}
+			var input txstore.Credit
+			input, eligible = eligible[0], eligible[1:]
+			inputs = append(inputs, input)
+			msgtx.AddTxIn(newRBFTxIn(input.OutPoint()))
+			if szEst, err = estimateTxSize(inputs, len(msgtx.TxOut), w.Manager); err != nil {
+				return nil, err
+			}
+			totalAdded += input.Amount()
+			feeEst = minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, inputs, bs.Height)
+		}
+	}
+
+	if err := validateMsgTx(msgtx, inputs); err != nil {
+		return nil, err
+	}
+	if err := validateAuthors(msgtx, inputs, authorAddrs, w.Manager); err != nil {
+		return nil, err
+	}
+
+	// Broadcast before recording the tx in the TxStore: if SendRawTransaction
+	// fails, nothing has been inserted, so there's nothing to roll back.
+	txSha, err := chainSrv.SendRawTransaction(msgtx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("Inserting new tx into the TxStore.")
+	if err = insertIntoStore(w.TxStore, msgtx); err != nil {
+		return nil, err
+	}
+	log.Infof("Successfully sent %d batched bulletins in %v", len(cmd.Bulletins), txSha)
+
+	return txSha.String(), nil
+}
+
+// validateAuthors checks that every address in authorAddrs actually signs
+// one of tx's inputs, so a bulletin in the batch can never be attributed to
+// an address whose owner did not consent to authoring it.
+func validateAuthors(tx *wire.MsgTx, inputs []txstore.Credit, authorAddrs []btcutil.Address, mgr *waddrmgr.Manager) error {
+	signed := make(map[string]bool, len(inputs))
+	for i, credit := range inputs {
+		_, addrs, _, err := credit.Addresses(activeNet.Params)
+		if err != nil {
+			return err
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		if inputIsSigned(tx, i) {
+			signed[addrs[0].EncodeAddress()] = true
+		}
+	}
+
+	for _, addr := range authorAddrs {
+		if !signed[addr.EncodeAddress()] {
+			return fmt.Errorf("author %s did not sign any input in the batched transaction", addr.EncodeAddress())
+		}
+	}
+	return nil
+}
+
+// inputIsSigned reports whether tx's i'th input carries a SignatureScript
+// or witness, i.e. whether it has been signed.
+func inputIsSigned(tx *wire.MsgTx, i int) bool {
+	in := tx.TxIn[i]
+	return len(in.SignatureScript) > 0 || len(in.Witness) > 0
+}
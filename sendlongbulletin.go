@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombudslib/protocol/ombproto"
+	"github.com/soapboxsys/ombudslib/rpcexten"
+	"github.com/soapboxsys/ombwallet/chain"
+	"github.com/soapboxsys/ombwallet/txstore"
+)
+
+// maxFragmentLen is the largest message fragment, in bytes, that fits
+// alongside a sequence header (fragment index, fragment total, and a
+// 32-byte content id) in a single bulletin's OP_RETURN/burn-output budget.
+const maxFragmentLen = 60
+
+// TODO NOTICE
+// Handles a sendlongbulletin json request. Splits cmd.Message into ordered
+// fragments and posts them as a CPFP-style chain of bulletin transactions:
+// tx[0] spends the author's credit and pays a change output back to addr;
+// tx[1] spends that change output as its own authoring input, and so on
+// until the final fragment. Every fragment carries a shared content id
+// (sha256 of the full message) plus its index and the total fragment count,
+// so the chain can be reassembled even if a reader observes the
+// transactions out of order.
+func SendLongBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interface{}, error) {
+	cmd := icmd.(rpcexten.SendLongBulletinCmd)
+
+	log.Trace("Starting long bulletin send")
+	heldUnlock, err := w.HoldUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer heldUnlock.Release()
+
+	addr, err := btcutil.DecodeAddress(cmd.Address, activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Manager.Address(addr); err != nil {
+		return nil, err
+	}
+
+	bs, err := chainSrv.BlockStamp()
+	if err != nil {
+		return nil, err
+	}
+
+	eligible, err := w.findEligibleOutputs(1, bs)
+	if err != nil {
+		return nil, err
+	}
+	i, err := findAddrCredit(eligible, addr, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	authc := eligible[i]
+
+	contentID := sha256.Sum256([]byte(cmd.Message))
+	fragments := splitMessage(cmd.Message, maxFragmentLen)
+	total := uint32(len(fragments))
+	log.Infof("Splitting bulletin into %d fragments, content id %x", total, contentID)
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every change hop in the chain pays back to addr, so every input after
+	// the first spends a script of this same kind. Bare multisig change
+	// can't be signed here (it needs a full txstore.Credit to look up the
+	// redeem script and collect cosigner signatures out-of-band), so a
+	// multisig author must use sendbulletin/signbulletin per-fragment
+	// instead of sendlongbulletin's single-wallet chain.
+	chainKind, err := classifyScript(pkScript, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	if chainKind == inputP2SHMultisig {
+		return nil, fmt.Errorf("sendlongbulletin does not support a multisig author address %q;"+
+			" send each fragment individually with signbulletin instead", cmd.Address)
+	}
+	base, witness := inputSizeForKind(chainKind)
+
+	chainTxs := make([]*wire.MsgTx, 0, len(fragments))
+
+	// cumulativeSize and cumulativePaidFee track the chain built so far, so
+	// each fragment's fee tops the package up to w.FeeIncrement applied to
+	// the whole chain rather than to that fragment alone -- a child transaction
+	// deep in the chain is cheap exactly because its ancestors already paid
+	// most of the package's required fee.
+	var (
+		prevOut           *wire.OutPoint
+		prevAmount        btcutil.Amount
+		cumulativeSize    int
+		cumulativePaidFee btcutil.Amount
+	)
+	for idx, frag := range fragments {
+		msgtx := wire.NewMsgTx()
+
+		var inAmount btcutil.Amount
+		if idx == 0 {
+			msgtx.AddTxIn(newRBFTxIn(authc.OutPoint()))
+			inAmount = authc.Amount()
+		} else {
+			msgtx.AddTxIn(newRBFTxIn(prevOut))
+			inAmount = prevAmount
+		}
+
+		bltn, err := ombproto.NewSequencedBulletinFromStr(cmd.Address, cmd.Board, frag,
+			uint32(idx), total, contentID)
+		if err != nil {
+			return nil, err
+		}
+		txouts, err := bltn.TxOuts(rpcexten.DustAmnt(), activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+		var burn btcutil.Amount
+		for _, txout := range txouts {
+			msgtx.AddTxOut(txout)
+			burn += btcutil.Amount(txout.Value)
+		}
+
+		last := idx == len(fragments)-1
+
+		// Every fragment is sized as if it carries a change output, even
+		// the last: whether the last fragment actually ends up needing one
+		// depends on the computed change amount below, and sizing it in
+		// ahead of time (rather than only for non-last fragments) avoids
+		// under-estimating its fee.
+		numOutputs := len(txouts) + 1
+		baseSz := 10 + base + numOutputs*txOutEstimate
+		vsize := (baseSz*3 + baseSz + witness) / 4
+		feeEst := feeForSize(w.FeeIncrement, cumulativeSize+vsize) - cumulativePaidFee
+		if feeEst < 0 {
+			feeEst = 0
+		}
+
+		change := inAmount - burn - feeEst
+		if change < 0 {
+			return nil, InsufficientFundsError{inAmount, burn, feeEst}
+		}
+
+		var feePaid btcutil.Amount
+		changeIdx := -1
+		if !last {
+			// Every fragment but the last must forward its change as the
+			// next hop's authoring input, so it can't be dust.
+			if change <= rpcexten.DustAmnt() {
+				return nil, InsufficientFundsError{inAmount, burn + rpcexten.DustAmnt(), feeEst}
+			}
+			msgtx.AddTxOut(wire.NewTxOut(int64(change), pkScript))
+			changeIdx = len(msgtx.TxOut) - 1
+			feePaid = feeEst
+		} else if change > rpcexten.DustAmnt() {
+			// Real leftover on the final fragment is returned to addr as
+			// an ordinary change output, rather than being folded into
+			// the fee.
+			msgtx.AddTxOut(wire.NewTxOut(int64(change), pkScript))
+			changeIdx = len(msgtx.TxOut) - 1
+			feePaid = feeEst
+		} else {
+			// Leftover too small to be worth its own output; fold it into
+			// the fee instead of creating a dust output.
+			feePaid = inAmount - burn
+		}
+
+		hashCache := txscript.NewTxSigHashes(msgtx)
+		if idx == 0 {
+			if err = signMsgTx(msgtx, []txstore.Credit{authc}, w.Manager, hashCache); err != nil {
+				return nil, err
+			}
+		} else {
+			if err = signScriptInput(msgtx, 0, chainKind, pkScript, prevAmount, w.Manager, hashCache); err != nil {
+				return nil, err
+			}
+		}
+
+		cumulativeSize += msgtx.SerializeSize()
+		cumulativePaidFee += feePaid
+
+		chainTxs = append(chainTxs, msgtx)
+		if !last {
+			prevOut = &wire.OutPoint{Hash: msgtx.TxSha(), Index: uint32(changeIdx)}
+			prevAmount = change
+		}
+	}
+
+	// Broadcast and insert each fragment in lockstep, rather than inserting
+	// the whole chain up front and broadcasting it afterward: if a
+	// mid-chain broadcast fails, every fragment already broadcast is
+	// recorded in the TxStore (as it must be, since it's now live on the
+	// network) and the failed fragment and every fragment after it were
+	// never inserted at all, so there's nothing to roll back.
+	shas := make([]string, 0, len(chainTxs))
+	for idx, tx := range chainTxs {
+		txSha, err := chainSrv.SendRawTransaction(tx, false)
+		if err != nil {
+			return nil, fmt.Errorf("broadcast of fragment %d/%d failed after %d fragments were already"+
+				" broadcast (txids already sent: %v): %v", idx, total, len(shas), shas, err)
+		}
+		if err := insertIntoStore(w.TxStore, tx); err != nil {
+			return nil, err
+		}
+		shas = append(shas, txSha.String())
+	}
+	log.Infof("Successfully sent %d-part bulletin chain, content id %x", total, contentID)
+
+	return shas, nil
+}
+
+// splitMessage splits msg into chunks no longer than max bytes, always
+// returning at least one (possibly empty) chunk.
+func splitMessage(msg string, max int) []string {
+	if len(msg) == 0 {
+		return []string{""}
+	}
+
+	var fragments []string
+	for len(msg) > 0 {
+		n := max
+		if n > len(msg) {
+			n = len(msg)
+		}
+		fragments = append(fragments, msg[:n])
+		msg = msg[n:]
+	}
+	return fragments
+}
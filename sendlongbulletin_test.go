@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		max  int
+		want []string
+	}{
+		{"empty", "", 10, []string{""}},
+		{"shorter than max", "hello", 10, []string{"hello"}},
+		{"exact multiple", "abcdefghij", 5, []string{"abcde", "fghij"}},
+		{"uneven remainder", "abcdefghi", 4, []string{"abcd", "efgh", "i"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := splitMessage(tc.msg, tc.max)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("splitMessage(%q, %d) = %v, want %v", tc.msg, tc.max, got, tc.want)
+			}
+		})
+	}
+}
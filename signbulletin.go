@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/soapboxsys/ombudslib/protocol/ombproto"
+	"github.com/soapboxsys/ombudslib/rpcexten"
+	"github.com/soapboxsys/ombwallet/chain"
+	"github.com/soapboxsys/ombwallet/txstore"
+	"github.com/soapboxsys/ombwallet/waddrmgr"
+)
+
+// BulletinSigPackage is the PSBT-like blob exchanged between cosigners of a
+// multisig-authored bulletin. It carries the unsigned (or partially signed)
+// transaction along with enough side information -- each input's redeem
+// script and the partial signatures collected so far, keyed by the signing
+// pubkey -- for any cosigner to add their own signature without needing
+// access to the wallet that originated the bulletin.
+type BulletinSigPackage struct {
+	Tx []byte `json:"tx"`
+	// RedeemScripts maps input index to the hex-encoded redeem script it
+	// spends, for every P2SH-multisig input in Tx.
+	RedeemScripts map[int]string `json:"redeemscripts"`
+	// Sigs maps input index to a map of cosigner pubkey (hex) to that
+	// cosigner's SigHashAll signature (hex) for that input.
+	Sigs map[int]map[string]string `json:"sigs"`
+}
+
+// TODO NOTICE
+// Handles a signbulletin json request: phase one, given {address, board,
+// message}, builds the bulletin transaction and returns a
+// BulletinSigPackage containing the local wallet's signatures; phase two,
+// given a previously-returned (and possibly cosigner-augmented)
+// BulletinSigPackage, adds this wallet's signatures, and -- once enough
+// cosigners have signed each multisig input -- finalizes and broadcasts.
+func SignBulletin(w *Wallet, chainSrv *chain.Client, icmd btcjson.Cmd) (interface{}, error) {
+	cmd := icmd.(rpcexten.SignBulletinCmd)
+
+	if cmd.Package != nil {
+		return signBulletinPhaseTwo(w, chainSrv, cmd.Package)
+	}
+	return signBulletinPhaseOne(w, chainSrv, cmd)
+}
+
+// signBulletinPhaseOne builds the bulletin transaction for cmd and returns
+// it, together with this wallet's partial signatures, as a
+// BulletinSigPackage that can be handed to the remaining cosigners.
+func signBulletinPhaseOne(w *Wallet, chainSrv *chain.Client, cmd rpcexten.SignBulletinCmd) (interface{}, error) {
+	heldUnlock, err := w.HoldUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer heldUnlock.Release()
+
+	addr, err := btcutil.DecodeAddress(cmd.Address, activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+	// The bulletin's author-address commitment references the P2SH
+	// multisig address itself, never any single cosigner's pubkey, so the
+	// call below is unchanged from the single-sig path.
+	bltn, err := ombproto.NewBulletinFromStr(cmd.Address, cmd.Board, cmd.Message)
+	if err != nil {
+		return nil, err
+	}
+	txouts, err := bltn.TxOuts(rpcexten.DustAmnt(), activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+	msgtx := wire.NewMsgTx()
+	var totalBurn btcutil.Amount
+	for _, txout := range txouts {
+		msgtx.AddTxOut(txout)
+		totalBurn += btcutil.Amount(txout.Value)
+	}
+
+	bs, err := chainSrv.BlockStamp()
+	if err != nil {
+		return nil, err
+	}
+	eligible, err := w.findEligibleOutputs(1, bs)
+	if err != nil {
+		return nil, err
+	}
+	i, err := findAddrCredit(eligible, addr, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	authc := eligible[i]
+	msgtx.AddTxIn(newRBFTxIn(authc.OutPoint()))
+
+	redeem, err := redeemScriptForCredit(authc, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+
+	szEst, err := estimateTxSize([]txstore.Credit{authc}, len(msgtx.TxOut)+1, w.Manager)
+	if err != nil {
+		return nil, err
+	}
+	feeEst := minimumFee(w.FeeIncrement, szEst, msgtx.TxOut, []txstore.Credit{authc}, bs.Height)
+	change := authc.Amount() - totalBurn - feeEst
+	if change < 0 {
+		return nil, InsufficientFundsError{authc.Amount(), totalBurn, feeEst}
+	}
+	if change > 0 {
+		pkScript, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
+		}
+		msgtx.AddTxOut(wire.NewTxOut(int64(change), pkScript))
+	}
+
+	sigs := make(map[string]string)
+	if err := addLocalMultisigSigs(msgtx, 0, authc, redeem, w.Manager, sigs); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := msgtx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return &BulletinSigPackage{
+		Tx:            buf.Bytes(),
+		RedeemScripts: map[int]string{0: hex.EncodeToString(redeem)},
+		Sigs:          map[int]map[string]string{0: sigs},
+	}, nil
+}
+
+// signBulletinPhaseTwo adds this wallet's signatures to pkg, then finalizes
+// and broadcasts it once every multisig input has met its threshold.
+func signBulletinPhaseTwo(w *Wallet, chainSrv *chain.Client, pkg *BulletinSigPackage) (interface{}, error) {
+	heldUnlock, err := w.HoldUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer heldUnlock.Release()
+
+	msgtx := wire.NewMsgTx()
+	if err := msgtx.Deserialize(bytes.NewReader(pkg.Tx)); err != nil {
+		return nil, err
+	}
+	if pkg.Sigs == nil {
+		// A cosigner-constructed package may omit Sigs entirely if it
+		// hasn't collected any signatures of its own yet.
+		pkg.Sigs = make(map[int]map[string]string)
+	}
+
+	bs, err := chainSrv.BlockStamp()
+	if err != nil {
+		return nil, err
+	}
+	eligible, err := w.findEligibleOutputs(0, bs)
+	if err != nil {
+		return nil, err
+	}
+	creditByOutPoint := make(map[wire.OutPoint]txstore.Credit, len(eligible))
+	for _, c := range eligible {
+		creditByOutPoint[*c.OutPoint()] = c
+	}
+
+	allFinal := true
+	for idx, in := range msgtx.TxIn {
+		redeemHex, ok := pkg.RedeemScripts[idx]
+		if !ok {
+			// Not a multisig input; assume it arrived already final.
+			continue
+		}
+		redeem, err := hex.DecodeString(redeemHex)
+		if err != nil {
+			return nil, err
+		}
+		credit, ok := creditByOutPoint[in.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("credit for input %d (%v) is not known to this wallet", idx, in.PreviousOutPoint)
+		}
+
+		sigs := pkg.Sigs[idx]
+		if sigs == nil {
+			sigs = make(map[string]string)
+			pkg.Sigs[idx] = sigs
+		}
+		if err := addLocalMultisigSigs(msgtx, idx, credit, redeem, w.Manager, sigs); err != nil {
+			return nil, err
+		}
+
+		_, _, required, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+		if err != nil {
+			return nil, err
+		}
+		if len(sigs) >= required {
+			sigScript, err := finalizeMultisigScript(redeem, sigs)
+			if err != nil {
+				return nil, err
+			}
+			msgtx.TxIn[idx].SignatureScript = sigScript
+		} else {
+			allFinal = false
+		}
+	}
+
+	if !allFinal {
+		var buf bytes.Buffer
+		if err := msgtx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		pkg.Tx = buf.Bytes()
+		return pkg, nil
+	}
+
+	inputs := make([]txstore.Credit, len(msgtx.TxIn))
+	for idx, in := range msgtx.TxIn {
+		credit, ok := creditByOutPoint[in.PreviousOutPoint]
+		if !ok {
+			return nil, fmt.Errorf("credit for input %d (%v) is not known to this wallet", idx, in.PreviousOutPoint)
+		}
+		inputs[idx] = credit
+	}
+	if err := validateMsgTx(msgtx, inputs); err != nil {
+		return nil, err
+	}
+
+	if err := insertIntoStore(w.TxStore, msgtx); err != nil {
+		return nil, err
+	}
+	txSha, err := chainSrv.SendRawTransaction(msgtx, false)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Successfully sent multisig-authored bulletin %v", txSha)
+	return txSha.String(), nil
+}
+
+// redeemScriptForCredit returns the redeem script backing a P2SH credit.
+func redeemScriptForCredit(credit txstore.Credit, mgr *waddrmgr.Manager) ([]byte, error) {
+	_, addrs, _, err := credit.Addresses(activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+	ainfo, err := mgr.Address(addrs[0])
+	if err != nil {
+		return nil, err
+	}
+	sa, ok := ainfo.(waddrmgr.ManagedScriptAddress)
+	if !ok {
+		return nil, fmt.Errorf("credit %v is not a managed script address", credit.OutPoint())
+	}
+	return sa.Script()
+}
+
+// addLocalMultisigSigs adds a SigHashAll signature for every cosigner
+// pubkey in redeem that this wallet holds the private key for, keyed by
+// that pubkey's ScriptAddress() hex encoding -- the same key
+// finalizeMultisigScript looks signatures up by -- merging into the sigs
+// map the caller supplies. Keying by ScriptAddress() rather than by
+// re-deriving the key's compressed encoding matters when redeem encodes a
+// cosigner's pubkey uncompressed: the two would otherwise never match.
+func addLocalMultisigSigs(tx *wire.MsgTx, i int, credit txstore.Credit, redeem []byte, mgr *waddrmgr.Manager, sigs map[string]string) error {
+	_, pubkeyAddrs, _, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, pkAddr := range pubkeyAddrs {
+		ainfo, err := mgr.Address(pkAddr)
+		if err != nil {
+			// This wallet doesn't hold this cosigner's key; nothing to add.
+			continue
+		}
+		pka, ok := ainfo.(waddrmgr.ManagedPubKeyAddress)
+		if !ok {
+			continue
+		}
+		privKey, err := pka.PrivKey()
+		if err != nil {
+			continue
+		}
+		sig, err := txscript.RawTxInSignature(tx, i, redeem, txscript.SigHashAll, privKey)
+		if err != nil {
+			return err
+		}
+		sigs[hex.EncodeToString(pkAddr.ScriptAddress())] = hex.EncodeToString(sig)
+	}
+	return nil
+}
+
+// finalizeMultisigScript assembles a complete scriptSig for a bare multisig
+// redeem script: OP_0 followed by the collected signatures and the redeem
+// script itself. OP_CHECKMULTISIG requires signatures to appear in the same
+// relative order as their pubkeys in the redeem script, so sigs with no
+// corresponding pubkey entry here are silently skipped and the rest are
+// emitted in redeem-script pubkey order, never in sigs' (random) map
+// iteration order. OP_CHECKMULTISIG consumes exactly the redeem script's
+// required number of signatures, so any beyond that are left out.
+func finalizeMultisigScript(redeem []byte, sigs map[string]string) ([]byte, error) {
+	_, pubkeyAddrs, required, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := txscript.NewScriptBuilder()
+	builder.AddOp(txscript.OP_0)
+	added := 0
+	for _, pkAddr := range pubkeyAddrs {
+		if added == required {
+			break
+		}
+		pkAddr, ok := pkAddr.(*btcutil.AddressPubKey)
+		if !ok {
+			continue
+		}
+		sigHex, ok := sigs[hex.EncodeToString(pkAddr.ScriptAddress())]
+		if !ok {
+			continue
+		}
+		sig, err := hex.DecodeString(sigHex)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddData(sig)
+		added++
+	}
+	builder.AddData(redeem)
+	return builder.Script()
+}
+
+// signMultisigCreditInPlace fully signs a bare multisig credit using only
+// this wallet's own keys, for the case where a single wallet happens to
+// hold every cosigner's key. It returns an error if that isn't enough to
+// meet the redeem script's threshold; callers in that situation should use
+// the two-phase signbulletin RPC instead.
+func signMultisigCreditInPlace(tx *wire.MsgTx, i int, credit txstore.Credit, mgr *waddrmgr.Manager) error {
+	redeem, err := redeemScriptForCredit(credit, mgr)
+	if err != nil {
+		return err
+	}
+	_, _, required, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+	if err != nil {
+		return err
+	}
+
+	sigs := make(map[string]string)
+	if err := addLocalMultisigSigs(tx, i, credit, redeem, mgr, sigs); err != nil {
+		return err
+	}
+	if len(sigs) < required {
+		return fmt.Errorf("credit %v needs %d cosigner signatures but this wallet only holds %d;"+
+			" use signbulletin to collect the rest", credit.OutPoint(), required, len(sigs))
+	}
+
+	sigScript, err := finalizeMultisigScript(redeem, sigs)
+	if err != nil {
+		return err
+	}
+	tx.TxIn[i].SignatureScript = sigScript
+	return nil
+}
+
+// estimateMultisigInputSize returns the worst-case size, in bytes, of a
+// fully-signed P2SH-multisig input: outpoint + sequence + a scriptSig of
+// OP_0, one ~72-byte push per required signature, and a push of the redeem
+// script itself.
+func estimateMultisigInputSize(credit txstore.Credit, mgr *waddrmgr.Manager) (int, error) {
+	redeem, err := redeemScriptForCredit(credit, mgr)
+	if err != nil {
+		return 0, err
+	}
+	_, _, required, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+	if err != nil {
+		return 0, err
+	}
+	// outpoint(36) + sequence(4) + OP_0(1) + required*(push-opcode+sig) + redeem push
+	return 36 + 4 + 1 + required*(1+72) + 2 + len(redeem), nil
+}
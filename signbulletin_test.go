@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// TestFinalizeMultisigScriptOrdering builds a real 2-of-3 bare multisig
+// redeem script, signs it with two of the three cosigners (deliberately
+// skipping the middle pubkey), and checks that the scriptSig
+// finalizeMultisigScript assembles actually validates. OP_CHECKMULTISIG
+// requires signatures to appear in the same relative order as their
+// pubkeys in the redeem script; since sigs is a map, a naive
+// range-over-map assembly would only pass this test by chance.
+func TestFinalizeMultisigScriptOrdering(t *testing.T) {
+	var privKeys [3]*btcec.PrivateKey
+	var pubKeys [3][]byte
+	for i := range privKeys {
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			t.Fatalf("generating key %d: %v", i, err)
+		}
+		privKeys[i] = priv
+		pubKeys[i] = priv.PubKey().SerializeCompressed()
+	}
+
+	builder := txscript.NewScriptBuilder()
+	builder.AddOp(txscript.OP_2)
+	for _, pub := range pubKeys {
+		builder.AddData(pub)
+	}
+	builder.AddOp(txscript.OP_3)
+	builder.AddOp(txscript.OP_CHECKMULTISIG)
+	redeem, err := builder.Script()
+	if err != nil {
+		t.Fatalf("building redeem script: %v", err)
+	}
+
+	scriptAddr, err := btcutil.NewAddressScriptHash(redeem, activeNet.Params)
+	if err != nil {
+		t.Fatalf("building P2SH address: %v", err)
+	}
+	prevScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		t.Fatalf("building P2SH pkScript: %v", err)
+	}
+
+	var prevHash wire.ShaHash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatalf("generating prev hash: %v", err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil))
+	payScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		t.Fatalf("building output pkScript: %v", err)
+	}
+	tx.AddTxOut(wire.NewTxOut(1e8, payScript))
+
+	// Sign with cosigners 0 and 2, skipping 1, so a correct assembly must
+	// still match each signature against its own pubkey's position.
+	sigs := make(map[string]string)
+	for _, i := range []int{2, 0} {
+		sig, err := txscript.RawTxInSignature(tx, 0, redeem, txscript.SigHashAll, privKeys[i])
+		if err != nil {
+			t.Fatalf("signing with cosigner %d: %v", i, err)
+		}
+		sigs[hex.EncodeToString(pubKeys[i])] = hex.EncodeToString(sig)
+	}
+
+	sigScript, err := finalizeMultisigScript(redeem, sigs)
+	if err != nil {
+		t.Fatalf("finalizeMultisigScript: %v", err)
+	}
+	tx.TxIn[0].SignatureScript = sigScript
+
+	vm, err := txscript.NewEngine(prevScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, 1e8)
+	if err != nil {
+		t.Fatalf("building script engine: %v", err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Fatalf("scriptSig failed to validate: %v", err)
+	}
+}
+
+// TestMultisigSigKeyingMatchesScriptEncoding covers a 2-of-2 redeem script
+// where one cosigner's pubkey is encoded uncompressed. addLocalMultisigSigs
+// and finalizeMultisigScript must key their shared sigs map by the same
+// value -- pkAddr.ScriptAddress(), which reflects the pubkey exactly as it
+// appears in redeem -- or a signature for an uncompressed-key cosigner is
+// silently dropped and the threshold can never be met.
+func TestMultisigSigKeyingMatchesScriptEncoding(t *testing.T) {
+	compressedKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("generating compressed-cosigner key: %v", err)
+	}
+	uncompressedKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("generating uncompressed-cosigner key: %v", err)
+	}
+	compressedPub := compressedKey.PubKey().SerializeCompressed()
+	uncompressedPub := uncompressedKey.PubKey().SerializeUncompressed()
+
+	builder := txscript.NewScriptBuilder()
+	builder.AddOp(txscript.OP_2)
+	builder.AddData(compressedPub)
+	builder.AddData(uncompressedPub)
+	builder.AddOp(txscript.OP_2)
+	builder.AddOp(txscript.OP_CHECKMULTISIG)
+	redeem, err := builder.Script()
+	if err != nil {
+		t.Fatalf("building redeem script: %v", err)
+	}
+
+	scriptAddr, err := btcutil.NewAddressScriptHash(redeem, activeNet.Params)
+	if err != nil {
+		t.Fatalf("building P2SH address: %v", err)
+	}
+	prevScript, err := txscript.PayToAddrScript(scriptAddr)
+	if err != nil {
+		t.Fatalf("building P2SH pkScript: %v", err)
+	}
+
+	var prevHash wire.ShaHash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatalf("generating prev hash: %v", err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil))
+	tx.AddTxOut(wire.NewTxOut(1e8, prevScript))
+
+	_, pubkeyAddrs, _, err := txscript.ExtractPkScriptAddrs(redeem, activeNet.Params)
+	if err != nil {
+		t.Fatalf("extracting pubkey addrs: %v", err)
+	}
+
+	// Sanity check the premise: the uncompressed cosigner's ScriptAddress()
+	// (the pubkey bytes exactly as redeem encodes them) differs from the
+	// compressed serialization of the same key. Keying sigs by the latter
+	// would never match here.
+	var uncompressedAddr btcutil.Address
+	for _, pkAddr := range pubkeyAddrs {
+		if hex.EncodeToString(pkAddr.ScriptAddress()) == hex.EncodeToString(uncompressedPub) {
+			uncompressedAddr = pkAddr
+		}
+	}
+	if uncompressedAddr == nil {
+		t.Fatalf("did not find the uncompressed cosigner among the extracted pubkey addrs")
+	}
+	if ck, ok := uncompressedAddr.(*btcutil.AddressPubKey); ok {
+		if bytes.Equal(ck.ScriptAddress(), uncompressedKey.PubKey().SerializeCompressed()) {
+			t.Fatalf("ScriptAddress() unexpectedly matched the compressed encoding")
+		}
+	}
+
+	sigs := make(map[string]string)
+	for _, key := range []*btcec.PrivateKey{compressedKey, uncompressedKey} {
+		sig, err := txscript.RawTxInSignature(tx, 0, redeem, txscript.SigHashAll, key)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		var scriptAddrBytes []byte
+		for _, pkAddr := range pubkeyAddrs {
+			if ck, ok := pkAddr.(*btcutil.AddressPubKey); ok {
+				pub := ck.PubKey()
+				if pub.X.Cmp(key.PubKey().X) == 0 && pub.Y.Cmp(key.PubKey().Y) == 0 {
+					scriptAddrBytes = ck.ScriptAddress()
+				}
+			}
+		}
+		if scriptAddrBytes == nil {
+			t.Fatalf("did not find a pubkey addr for the signing key")
+		}
+		sigs[hex.EncodeToString(scriptAddrBytes)] = hex.EncodeToString(sig)
+	}
+
+	sigScript, err := finalizeMultisigScript(redeem, sigs)
+	if err != nil {
+		t.Fatalf("finalizeMultisigScript: %v", err)
+	}
+	tx.TxIn[0].SignatureScript = sigScript
+
+	vm, err := txscript.NewEngine(prevScript, tx, 0, txscript.StandardVerifyFlags, nil, nil, 1e8)
+	if err != nil {
+		t.Fatalf("building script engine: %v", err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Fatalf("scriptSig failed to validate: %v", err)
+	}
+}